@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+const (
+	infinibandVerbsPath = "infiniband_verbs"
+	infinibandMadPath   = "infiniband_mad"
+)
+
+// These are vars rather than consts so tests can point them at a fake
+// sysfs/devfs tree under t.TempDir().
+var (
+	infinibandClassPath = "/sys/class/infiniband"
+	pciDevicesPath      = "/sys/bus/pci/devices"
+	rdmaDevFsPath       = "/dev/infiniband"
+	rdmaCmDevicePath    = "/dev/infiniband/rdma_cm"
+)
+
+// vfResource holds everything Allocate needs to expose a single VF to a
+// container: the device nodes that belong to it, and the PCI/NUMA
+// information used for topology hints and env vars.
+type vfResource struct {
+	pciAddr string
+	ibDev   string
+	netdev  string
+	numa    int64
+	specs   []*pluginapi.DeviceSpec
+}
+
+// pciAddrOfIbDev resolves the PCI address backing an infiniband device by
+// following /sys/class/infiniband/<dev>/device, which is a symlink into
+// /sys/bus/pci/devices/<addr>.
+func pciAddrOfIbDev(ibDev string) (string, error) {
+	target, err := filepath.EvalSymlinks(filepath.Join(infinibandClassPath, ibDev, "device"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// ibDevForPciAddr returns the infiniband device name (e.g. mlx5_2) backed by
+// the given PCI address, or "" if none is found.
+func ibDevForPciAddr(pciAddr string) string {
+	entries, err := ioutil.ReadDir(infinibandClassPath)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		addr, err := pciAddrOfIbDev(entry.Name())
+		if err == nil && addr == pciAddr {
+			return entry.Name()
+		}
+	}
+	return ""
+}
+
+// numaNodeOfPci reads the NUMA node a PCI device is attached to. It returns
+// -1 (matching the sysfs convention for "no NUMA affinity") when unknown.
+func numaNodeOfPci(pciAddr string) int64 {
+	raw, err := ioutil.ReadFile(filepath.Join(pciDevicesPath, pciAddr, "numa_node"))
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// cdevSpecs walks the sysfs class directory for an infiniband device and
+// returns a DeviceSpec for every cdev that belongs to it: uverbsN under
+// infiniband_verbs, and issmN/umadN under infiniband_mad. It does not
+// include /dev/infiniband/rdma_cm, which is shared by every VF on the host
+// rather than owned by any one of them; rdmaCmDeviceSpec adds it once per
+// container request instead, so that allocating several VFs doesn't
+// duplicate it in ContainerAllocateResponse.Devices.
+func cdevSpecs(ibDev string) []*pluginapi.DeviceSpec {
+	specs := []*pluginapi.DeviceSpec{}
+
+	classDirs := map[string]string{
+		infinibandVerbsPath: rdmaDevFsPath,
+		infinibandMadPath:   rdmaDevFsPath,
+	}
+
+	for subdir, devRoot := range classDirs {
+		dirPath := filepath.Join(infinibandClassPath, ibDev, "device", subdir)
+		entries, err := ioutil.ReadDir(dirPath)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			devPath := filepath.Join(devRoot, entry.Name())
+			if _, err := os.Stat(devPath); err != nil {
+				continue
+			}
+			specs = append(specs, &pluginapi.DeviceSpec{
+				HostPath:      devPath,
+				ContainerPath: devPath,
+				Permissions:   "rwm",
+			})
+		}
+	}
+
+	return specs
+}
+
+// rdmaCmDeviceSpec returns the DeviceSpec for the shared
+// /dev/infiniband/rdma_cm node, or nil if the kernel doesn't expose it
+// (older kernels, or no RDMA CM support).
+func rdmaCmDeviceSpec() *pluginapi.DeviceSpec {
+	if _, err := os.Stat(rdmaCmDevicePath); err != nil {
+		return nil
+	}
+	return &pluginapi.DeviceSpec{
+		HostPath:      rdmaCmDevicePath,
+		ContainerPath: rdmaCmDevicePath,
+		Permissions:   "rwm",
+	}
+}
+
+// newVfResource builds the vfResource for the VF identified by pciAddr,
+// discovering its infiniband device and cdevs.
+func newVfResource(pciAddr, netdev string) (*vfResource, error) {
+	ibDev := ibDevForPciAddr(pciAddr)
+	if ibDev == "" {
+		return nil, fmt.Errorf("no infiniband device found for pci address %s", pciAddr)
+	}
+
+	specs := cdevSpecs(ibDev)
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no rdma cdevs found for infiniband device %s (pci %s)", ibDev, pciAddr)
+	}
+
+	return &vfResource{
+		pciAddr: pciAddr,
+		ibDev:   ibDev,
+		netdev:  netdev,
+		numa:    numaNodeOfPci(pciAddr),
+		specs:   specs,
+	}, nil
+}
+
+// topology returns the pluginapi Topology hint for this VF, or nil when the
+// NUMA node is unknown, matching how the device plugin API expects
+// topology-less devices to be represented.
+func (r *vfResource) topology() *pluginapi.TopologyInfo {
+	if r.numa < 0 {
+		return nil
+	}
+	return &pluginapi.TopologyInfo{
+		Nodes: []*pluginapi.NUMANode{
+			{ID: r.numa},
+		},
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withFakeSysfs points the sysfs/devfs path vars at directories under
+// t.TempDir() and restores the real paths on cleanup.
+func withFakeSysfs(t *testing.T) (classPath, pciPath, devPath string) {
+	t.Helper()
+
+	root := t.TempDir()
+	classPath = filepath.Join(root, "sys", "class", "infiniband")
+	pciPath = filepath.Join(root, "sys", "bus", "pci", "devices")
+	devPath = filepath.Join(root, "dev", "infiniband")
+
+	origClass, origPci, origDevFs, origRdmaCm := infinibandClassPath, pciDevicesPath, rdmaDevFsPath, rdmaCmDevicePath
+	infinibandClassPath = classPath
+	pciDevicesPath = pciPath
+	rdmaDevFsPath = devPath
+	rdmaCmDevicePath = filepath.Join(devPath, "rdma_cm")
+
+	t.Cleanup(func() {
+		infinibandClassPath, pciDevicesPath, rdmaDevFsPath, rdmaCmDevicePath = origClass, origPci, origDevFs, origRdmaCm
+	})
+
+	return classPath, pciPath, devPath
+}
+
+func mustMkdirAll(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatalf("MkdirAll(%s): %s", path, err)
+	}
+}
+
+func mustWriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	mustMkdirAll(t, filepath.Dir(path))
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile(%s): %s", path, err)
+	}
+}
+
+func TestIbDevForPciAddrAndNuma(t *testing.T) {
+	classPath, pciPath, _ := withFakeSysfs(t)
+
+	pciAddr := "0000:01:00.1"
+	mustMkdirAll(t, filepath.Join(pciPath, pciAddr))
+	mustWriteFile(t, filepath.Join(pciPath, pciAddr, "numa_node"), "1\n")
+
+	ibDev := "mlx5_2"
+	ibDevDir := filepath.Join(classPath, ibDev)
+	mustMkdirAll(t, ibDevDir)
+	if err := os.Symlink(filepath.Join(pciPath, pciAddr), filepath.Join(ibDevDir, "device")); err != nil {
+		t.Fatalf("Symlink: %s", err)
+	}
+
+	if got := ibDevForPciAddr(pciAddr); got != ibDev {
+		t.Fatalf("ibDevForPciAddr(%s) = %q, want %q", pciAddr, got, ibDev)
+	}
+
+	if got := ibDevForPciAddr("0000:99:00.0"); got != "" {
+		t.Fatalf("ibDevForPciAddr for unknown pci addr = %q, want \"\"", got)
+	}
+
+	if got := numaNodeOfPci(pciAddr); got != 1 {
+		t.Fatalf("numaNodeOfPci(%s) = %d, want 1", pciAddr, got)
+	}
+
+	if got := numaNodeOfPci("0000:ff:00.0"); got != -1 {
+		t.Fatalf("numaNodeOfPci for missing pci device = %d, want -1", got)
+	}
+}
+
+func TestCdevSpecs(t *testing.T) {
+	classPath, _, devPath := withFakeSysfs(t)
+
+	ibDev := "mlx5_2"
+	deviceDir := filepath.Join(classPath, ibDev, "device")
+	mustMkdirAll(t, filepath.Join(deviceDir, infinibandVerbsPath, "uverbs2"))
+	mustMkdirAll(t, filepath.Join(deviceDir, infinibandMadPath, "umad2"))
+	mustMkdirAll(t, filepath.Join(deviceDir, infinibandMadPath, "issm2"))
+
+	mustWriteFile(t, filepath.Join(devPath, "uverbs2"), "")
+	mustWriteFile(t, filepath.Join(devPath, "umad2"), "")
+	mustWriteFile(t, filepath.Join(devPath, "issm2"), "")
+	// rdma_cm is shared across VFs and deliberately NOT returned by
+	// cdevSpecs; see TestRdmaCmDeviceSpec.
+	mustWriteFile(t, rdmaCmDevicePath, "")
+
+	specs := cdevSpecs(ibDev)
+
+	want := map[string]bool{
+		filepath.Join(devPath, "uverbs2"): true,
+		filepath.Join(devPath, "umad2"):   true,
+		filepath.Join(devPath, "issm2"):   true,
+	}
+	if len(specs) != len(want) {
+		t.Fatalf("cdevSpecs(%s) returned %d specs, want %d", ibDev, len(specs), len(want))
+	}
+	for _, s := range specs {
+		if !want[s.HostPath] {
+			t.Errorf("unexpected device spec %s", s.HostPath)
+		}
+		if s.HostPath != s.ContainerPath {
+			t.Errorf("HostPath %s != ContainerPath %s", s.HostPath, s.ContainerPath)
+		}
+		if s.Permissions != "rwm" {
+			t.Errorf("Permissions = %q, want \"rwm\"", s.Permissions)
+		}
+	}
+}
+
+func TestRdmaCmDeviceSpec(t *testing.T) {
+	withFakeSysfs(t)
+
+	if spec := rdmaCmDeviceSpec(); spec != nil {
+		t.Fatalf("rdmaCmDeviceSpec with no rdma_cm node present = %v, want nil", spec)
+	}
+
+	mustWriteFile(t, rdmaCmDevicePath, "")
+
+	spec := rdmaCmDeviceSpec()
+	if spec == nil {
+		t.Fatal("rdmaCmDeviceSpec with rdma_cm node present = nil, want a spec")
+	}
+	if spec.HostPath != rdmaCmDevicePath || spec.ContainerPath != rdmaCmDevicePath || spec.Permissions != "rwm" {
+		t.Fatalf("rdmaCmDeviceSpec = %+v, want HostPath=ContainerPath=%s Permissions=rwm", spec, rdmaCmDevicePath)
+	}
+}
+
+func TestCdevSpecsNoCdevsPresent(t *testing.T) {
+	classPath, _, _ := withFakeSysfs(t)
+
+	ibDev := "mlx5_3"
+	mustMkdirAll(t, filepath.Join(classPath, ibDev, "device", infinibandVerbsPath))
+
+	if specs := cdevSpecs(ibDev); len(specs) != 0 {
+		t.Fatalf("cdevSpecs with no cdev nodes present = %d specs, want 0", len(specs))
+	}
+}
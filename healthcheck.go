@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+)
+
+// portPollInterval bounds how stale the RDMA port state can be between two
+// carrier-change events on a VF's netdev.
+const portPollInterval = 5 * time.Second
+
+// healthcheck monitors every advertised VF for link and RDMA port state and
+// pushes its current health into m.health on every link event for its
+// netdev and on every poll, whether or not it changed. Health moves in both
+// directions: a VF that recovers is reported Healthy again, not just marked
+// Unhealthy once.
+func (m *RdmaSriovDevPlugin) healthcheck() {
+	updates := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	if err := netlink.LinkSubscribe(updates, done); err != nil {
+		log.Printf("Could not subscribe to netlink link updates: %s", err)
+		return
+	}
+	defer close(done)
+
+	ticker := time.NewTicker(portPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case update := <-updates:
+			m.refreshHealth(update.Link.Attrs().Name)
+		case <-ticker.C:
+			for id := range m.vfResources {
+				m.refreshHealthByID(id)
+			}
+		}
+	}
+}
+
+// refreshHealth re-evaluates health for the VF whose netdev is netdevName,
+// if any.
+func (m *RdmaSriovDevPlugin) refreshHealth(netdevName string) {
+	for id, res := range m.vfResources {
+		if res.netdev == netdevName {
+			m.refreshHealthByID(id)
+			return
+		}
+	}
+}
+
+func (m *RdmaSriovDevPlugin) refreshHealthByID(id string) {
+	res, ok := m.vfResources[id]
+	if !ok {
+		return
+	}
+
+	health := pluginapi.Unhealthy
+	if linkCarrierUp(res.netdev) && portIsActive(res.ibDev) {
+		health = pluginapi.Healthy
+	}
+
+	m.setHealth(id, health)
+}
+
+// linkCarrierUp reports whether netdevName currently has carrier.
+func linkCarrierUp(netdevName string) bool {
+	link, err := netlink.LinkByName(netdevName)
+	if err != nil {
+		return false
+	}
+	return link.Attrs().OperState == netlink.OperUp
+}
+
+// portIsActive reports whether any port of ibDev is in the ACTIVE state, by
+// reading /sys/class/infiniband/<ibDev>/ports/*/state.
+func portIsActive(ibDev string) bool {
+	matches, err := filepath.Glob(filepath.Join(infinibandClassPath, ibDev, "ports", "*", "state"))
+	if err != nil {
+		return false
+	}
+
+	for _, stateFile := range matches {
+		raw, err := ioutil.ReadFile(stateFile)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(string(raw), "ACTIVE") {
+			return true
+		}
+	}
+	return false
+}
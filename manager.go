@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ResourceManager owns one RdmaSriovDevPlugin per resource pool declared in
+// the config file and keeps them in sync with it, reconfiguring only the
+// pools whose config actually changed on each reload.
+type ResourceManager struct {
+	configPath string
+
+	mu      sync.Mutex
+	plugins map[string]*RdmaSriovDevPlugin
+	applied map[string]UserConfig
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewResourceManager returns a ResourceManager that will load its config
+// from configPath.
+func NewResourceManager(configPath string) *ResourceManager {
+	return &ResourceManager{
+		configPath: configPath,
+		plugins:    map[string]*RdmaSriovDevPlugin{},
+		applied:    map[string]UserConfig{},
+		stop:       make(chan struct{}),
+	}
+}
+
+func loadConfig(configPath string) (Config, error) {
+	var cfg Config
+
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// Run loads the config, serves every resource pool, and watches the config
+// file for changes.
+func (rm *ResourceManager) Run() error {
+	cfg, err := loadConfig(rm.configPath)
+	if err != nil {
+		return err
+	}
+
+	rm.apply(cfg)
+
+	rm.wg.Add(1)
+	go func() {
+		defer rm.wg.Done()
+		rm.watchConfig()
+	}()
+
+	return nil
+}
+
+// resourceNameOf returns pool's resourceName, falling back to the default
+// when it doesn't set one.
+func resourceNameOf(pool UserConfig) string {
+	if pool.ResourceName == "" {
+		return RdmaSriovResourceName
+	}
+	return pool.ResourceName
+}
+
+// reconcilePools is the pure diffing logic behind apply: given the pools
+// already applied and the newly loaded config, it decides which pools need
+// to be (re)started and which running ones need to be stopped. It performs
+// no I/O so it can be tested without spinning up real gRPC servers.
+func reconcilePools(applied map[string]UserConfig, pools []UserConfig) (toStart []UserConfig, toStop []string) {
+	wanted := map[string]bool{}
+
+	for _, pool := range pools {
+		resourceName := resourceNameOf(pool)
+		wanted[resourceName] = true
+
+		if existing, ok := applied[resourceName]; ok && reflect.DeepEqual(existing, pool) {
+			continue
+		}
+		toStart = append(toStart, pool)
+	}
+
+	for resourceName := range applied {
+		if !wanted[resourceName] {
+			toStop = append(toStop, resourceName)
+		}
+	}
+
+	return toStart, toStop
+}
+
+// apply reconciles the running plugins against cfg: pools that are new or
+// whose config changed are (re)served, pools that disappeared are stopped.
+// Unchanged pools are left running, so a config change for one pool never
+// disturbs the others.
+func (rm *ResourceManager) apply(cfg Config) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	toStart, toStop := reconcilePools(rm.applied, cfg.ResourcePools)
+
+	for _, pool := range toStart {
+		resourceName := resourceNameOf(pool)
+
+		if old, ok := rm.plugins[resourceName]; ok {
+			log.Println("Reconfiguring resource pool", resourceName)
+			old.Stop()
+		}
+
+		plugin := NewRdmaSriovDevPlugin(pool)
+		if err := plugin.Serve(); err != nil {
+			log.Printf("Could not serve resource pool %s: %s", resourceName, err)
+			delete(rm.plugins, resourceName)
+			delete(rm.applied, resourceName)
+			continue
+		}
+
+		rm.plugins[resourceName] = plugin
+		rm.applied[resourceName] = pool
+	}
+
+	for _, resourceName := range toStop {
+		log.Println("Removing resource pool", resourceName)
+		if plugin, ok := rm.plugins[resourceName]; ok {
+			plugin.Stop()
+		}
+		delete(rm.plugins, resourceName)
+		delete(rm.applied, resourceName)
+	}
+}
+
+// watchConfig reloads and re-applies the config on every change, so that VF
+// counts and resource pools can be retuned without restarting the pod.
+//
+// It watches the parent directory rather than rm.configPath itself and
+// reloads on any Create/Write there, rather than matching the event's file
+// name against rm.configPath: a ConfigMap-mounted file is updated by an
+// atomic symlink swap of the "..data" entry in the parent directory, which
+// never generates an inotify event on rm.configPath's own dentry. Matching
+// on the exact path would silently defeat hot-reload for that (the common)
+// deployment pattern.
+func (rm *ResourceManager) watchConfig() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Could not start fsnotify watcher on %s: %s", rm.configPath, err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(rm.configPath)); err != nil {
+		log.Printf("Could not watch %s: %s", rm.configPath, err)
+		return
+	}
+
+	for {
+		select {
+		case <-rm.stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			cfg, err := loadConfig(rm.configPath)
+			if err != nil {
+				log.Printf("Could not reload config %s: %s", rm.configPath, err)
+				continue
+			}
+			log.Println("Config changed, reconfiguring resource pools")
+			rm.apply(cfg)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("fsnotify watcher error: %s", err)
+		}
+	}
+}
+
+// Stop stops every resource pool's gRPC server and the config watcher. It
+// waits for watchConfig to return first, so no apply() can race the map
+// iteration below.
+func (rm *ResourceManager) Stop() {
+	close(rm.stop)
+	rm.wg.Wait()
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	for _, plugin := range rm.plugins {
+		plugin.Stop()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReconcilePoolsStartsNewPool(t *testing.T) {
+	applied := map[string]UserConfig{}
+	pools := []UserConfig{{ResourceName: "rdma/vhca_a", PfNetdevices: []PfConfig{{Name: "ens1f0"}}}}
+
+	toStart, toStop := reconcilePools(applied, pools)
+
+	if len(toStop) != 0 {
+		t.Fatalf("toStop = %v, want empty", toStop)
+	}
+	if len(toStart) != 1 || !reflect.DeepEqual(toStart[0], pools[0]) {
+		t.Fatalf("toStart = %v, want %v", toStart, pools)
+	}
+}
+
+func TestReconcilePoolsSkipsUnchangedPool(t *testing.T) {
+	pool := UserConfig{ResourceName: "rdma/vhca_a", PfNetdevices: []PfConfig{{Name: "ens1f0"}}}
+	applied := map[string]UserConfig{"rdma/vhca_a": pool}
+
+	toStart, toStop := reconcilePools(applied, []UserConfig{pool})
+
+	if len(toStart) != 0 {
+		t.Fatalf("toStart = %v, want empty for an unchanged pool", toStart)
+	}
+	if len(toStop) != 0 {
+		t.Fatalf("toStop = %v, want empty", toStop)
+	}
+}
+
+func TestReconcilePoolsRestartsChangedPool(t *testing.T) {
+	applied := map[string]UserConfig{
+		"rdma/vhca_a": {ResourceName: "rdma/vhca_a", PfNetdevices: []PfConfig{{Name: "ens1f0", NumVfs: 2}}},
+	}
+	changed := UserConfig{ResourceName: "rdma/vhca_a", PfNetdevices: []PfConfig{{Name: "ens1f0", NumVfs: 4}}}
+
+	toStart, toStop := reconcilePools(applied, []UserConfig{changed})
+
+	if len(toStop) != 0 {
+		t.Fatalf("toStop = %v, want empty (the pool is replaced, not removed)", toStop)
+	}
+	if len(toStart) != 1 || !reflect.DeepEqual(toStart[0], changed) {
+		t.Fatalf("toStart = %v, want %v", toStart, changed)
+	}
+}
+
+func TestReconcilePoolsStopsRemovedPool(t *testing.T) {
+	applied := map[string]UserConfig{
+		"rdma/vhca_a": {ResourceName: "rdma/vhca_a"},
+		"rdma/vhca_b": {ResourceName: "rdma/vhca_b"},
+	}
+
+	toStart, toStop := reconcilePools(applied, []UserConfig{{ResourceName: "rdma/vhca_a"}})
+
+	if len(toStart) != 0 {
+		t.Fatalf("toStart = %v, want empty", toStart)
+	}
+	sort.Strings(toStop)
+	if !reflect.DeepEqual(toStop, []string{"rdma/vhca_b"}) {
+		t.Fatalf("toStop = %v, want [rdma/vhca_b]", toStop)
+	}
+}
+
+func TestReconcilePoolsDefaultsResourceName(t *testing.T) {
+	applied := map[string]UserConfig{}
+	pools := []UserConfig{{PfNetdevices: []PfConfig{{Name: "ens1f0"}}}}
+
+	toStart, toStop := reconcilePools(applied, pools)
+
+	if len(toStop) != 0 {
+		t.Fatalf("toStop = %v, want empty", toStop)
+	}
+	if len(toStart) != 1 {
+		t.Fatalf("toStart = %v, want one pool", toStart)
+	}
+
+	// A pool with no resourceName is keyed by the default on the next
+	// reconcile, so an unchanged re-apply must not restart it.
+	nextApplied := map[string]UserConfig{resourceNameOf(toStart[0]): toStart[0]}
+	toStart, toStop = reconcilePools(nextApplied, pools)
+	if len(toStart) != 0 || len(toStop) != 0 {
+		t.Fatalf("re-applying the same defaulted pool should be a no-op, got toStart=%v toStop=%v", toStart, toStop)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/net/context"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1"
+)
+
+const (
+	// PluginRegistrationPath is the directory kubelet watches for plugin
+	// sockets under the newer plugin-registration protocol.
+	PluginRegistrationPath = "/var/lib/kubelet/plugins_registry"
+)
+
+// usesWatcherRegistration reports whether kubelet's plugin watcher is
+// available on this node, i.e. PluginRegistrationPath exists.
+func usesWatcherRegistration() bool {
+	info, err := os.Stat(PluginRegistrationPath)
+	return err == nil && info.IsDir()
+}
+
+// GetInfo is part of the registerapi.RegistrationServer interface. It is
+// called by kubelet's plugin watcher when it discovers our socket.
+func (m *RdmaSriovDevPlugin) GetInfo(ctx context.Context, req *registerapi.InfoRequest) (*registerapi.PluginInfo, error) {
+	return &registerapi.PluginInfo{
+		Type:              registerapi.DevicePlugin,
+		Name:              m.resourceName,
+		Endpoint:          m.socket,
+		SupportedVersions: []string{pluginapiVersion},
+	}, nil
+}
+
+// NotifyRegistrationStatus is part of the registerapi.RegistrationServer
+// interface. Kubelet calls it once it has finished (or failed) registering
+// the plugin we advertised via GetInfo.
+func (m *RdmaSriovDevPlugin) NotifyRegistrationStatus(ctx context.Context, status *registerapi.RegistrationStatus) (*registerapi.RegistrationStatusResponse, error) {
+	if !status.PluginRegistered {
+		log.Printf("Registration with kubelet failed: %s", status.Error)
+	} else {
+		log.Println("Registered device plugin with Kubelet via plugin watcher")
+	}
+	return &registerapi.RegistrationStatusResponse{}, nil
+}
+
+// watchKubeletRestart watches the plugin-registration directory for our
+// socket file being created or removed, and re-publishes the socket via
+// publishSocket when it has gone missing, which happens across a kubelet
+// restart.
+func (m *RdmaSriovDevPlugin) watchKubeletRestart() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Could not start fsnotify watcher on %s: %s", PluginRegistrationPath, err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(PluginRegistrationPath); err != nil {
+		log.Printf("Could not watch %s: %s", PluginRegistrationPath, err)
+		return
+	}
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != filepath.Base(m.socket) {
+				continue
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Remove) == 0 {
+				continue
+			}
+			log.Println("Detected kubelet plugin watcher activity, re-publishing socket")
+			if err := m.publishSocket(); err != nil {
+				log.Printf("Failed to re-publish socket: %s", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("fsnotify watcher error: %s", err)
+		}
+	}
+}
+
+// publishSocket makes sure the plugin socket exists at m.socket so that
+// kubelet's plugin watcher can find it. A kubelet restart wipes
+// PluginRegistrationPath, which removes our socket file out from under the
+// still-running listener; when that happens we stop the stale server and
+// recreate the socket and gRPC handlers from scratch.
+func (m *RdmaSriovDevPlugin) publishSocket() error {
+	if _, err := os.Stat(m.socket); err == nil {
+		return nil
+	}
+
+	if m.server != nil {
+		m.server.Stop()
+	}
+
+	return m.listen()
+}
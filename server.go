@@ -6,35 +6,117 @@ import (
 	"net"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/Mellanox/sriovnet"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	pluginapi "k8s.io/kubernetes/pkg/kubelet/apis/deviceplugin/v1beta1"
+	registerapi "k8s.io/kubernetes/pkg/kubelet/apis/pluginregistration/v1"
 )
 
 const (
 	RdmaSriovDpSocket = "rdma-sriov-dp.sock"
+
+	// pluginapiVersion is advertised to kubelet both on the legacy
+	// Register() RPC and on GetInfo() under the plugin watcher protocol.
+	pluginapiVersion = pluginapi.Version
 )
 
+// socketFileName derives a socket file name for resourceName so that
+// several pools served by the same binary don't collide on disk.
+func socketFileName(resourceName string) string {
+	if resourceName == RdmaSriovResourceName {
+		return RdmaSriovDpSocket
+	}
+	return strings.NewReplacer("/", "_").Replace(resourceName) + "-dp.sock"
+}
+
+// pciDeviceEnvPrefix derives the PCIDEVICE_* env var prefix for
+// resourceName, matching the convention downstream CNIs expect. It must be
+// derived per resource pool rather than hardcoded: kubelet merges the Envs
+// of every per-resource ContainerAllocateResponse into one container spec,
+// so two pools sharing a prefix would silently clobber each other's PCI
+// address env vars.
+func pciDeviceEnvPrefix(resourceName string) string {
+	sanitized := strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(resourceName)
+	return "PCIDEVICE_" + strings.ToUpper(sanitized) + "_"
+}
+
 const (
+	// RdmaSriovResourceName is the resourceName used for a pool that
+	// does not set its own.
 	RdmaSriovResourceName = "rdma/vhca"
-)
 
-const (
-	RdmaDevices = "/dev/infiniband"
+	// Supported UserConfig.DeviceType values.
+	DeviceTypeNetdevice = "netdevice"
+	DeviceTypeVfioPci   = "vfio-pci"
+	DeviceTypeRdma      = "rdma"
 )
 
+// PfConfig describes a single physical function and how its VFs should be
+// provisioned.
+type PfConfig struct {
+	Name string `json:"name"`
+
+	// NumVfs is the number of VFs expected on this PF. When
+	// ExternallyManaged is set and NumVfs is non-zero, the number of VFs
+	// present must match it exactly; when it is zero, any non-zero number
+	// of VFs is accepted. Otherwise it is advisory only, since ConfigVfs
+	// configures all VFs reported by the driver.
+	NumVfs int `json:"numVfs,omitempty"`
+
+	// ExternallyManaged, when set, tells the plugin that VFs on this PF
+	// are already provisioned by NetworkManager, nmstate, or another
+	// operator. The plugin will not call EnableSriov/ConfigVfs and will
+	// only discover and validate the existing VFs.
+	ExternallyManaged bool `json:"externallyManaged,omitempty"`
+
+	// VfSelector, when set, is a filepath.Match pattern matched against
+	// each VF's PCI address (e.g. "0000:01:00.*"). VFs that don't match
+	// are not advertised by this resource pool; SR-IOV configuration of
+	// the PF is not affected by the selector. An empty selector matches
+	// every VF on the PF.
+	VfSelector string `json:"vfSelector,omitempty"`
+}
+
+// UserConfig describes one resource pool: a resourceName advertised to
+// kubelet, the PFs that back it, and how its devices should be exposed.
 type UserConfig struct {
-	PfNetdevices []string `json:"pfNetdevices"`
+	// ResourceName is the extended resource advertised to kubelet, e.g.
+	// "rdma/vhca_a". Defaults to RdmaSriovResourceName.
+	ResourceName string `json:"resourceName,omitempty"`
+
+	PfNetdevices []PfConfig `json:"pfNetdevices"`
+
+	// ExternallyManaged, when set, marks every PF of the pool as
+	// externally managed. A PF can set its own ExternallyManaged to turn
+	// the mode on for itself, but cannot turn it off when this is set.
+	ExternallyManaged bool `json:"externallyManaged,omitempty"`
+
+	// DeviceType selects how devices are exposed to the container.
+	// Defaults to DeviceTypeRdma, which is the only mode currently
+	// implemented; the others are accepted as valid values, matching
+	// sriov-network-device-plugin's config format, but for them
+	// NewRdmaSriovDevPlugin logs an error and returns a plugin with no
+	// devices rather than silently falling back to RDMA cdev exposure.
+	DeviceType string `json:"deviceType,omitempty"`
+}
+
+// Config is the top-level config file format: one binary can serve several
+// resource pools, each advertised and reconfigured independently.
+type Config struct {
+	ResourcePools []UserConfig `json:"resourcePools"`
 }
 
 // RdmaSriovDevPlugin implements the Kubernetes device plugin API
 type RdmaSriovDevPlugin struct {
 	resourceName string
 	socket       string
+	watcherMode  bool
 	devs         []*pluginapi.Device
+	vfResources  map[string]*vfResource
 
 	stop   chan interface{}
 	health chan *pluginapi.Device
@@ -42,10 +124,30 @@ type RdmaSriovDevPlugin struct {
 	server *grpc.Server
 }
 
-func configSriov(pfNetdevName string) (*sriovnet.PfNetdevHandle, error) {
-	var err error
+// configSriov configures SR-IOV on pfNetdevName and returns its PF handle.
+// When externallyManaged is set, SR-IOV is assumed to already be configured
+// by another operator: the PF handle is only used to enumerate the VFs that
+// are already present, and EnableSriov/ConfigVfs are never called.
+func configSriov(pf PfConfig) (*sriovnet.PfNetdevHandle, error) {
+	pfNetdevName := pf.Name
+
+	if pf.ExternallyManaged {
+		pfHandle, err := sriovnet.GetPfNetdevHandle(pfNetdevName)
+		if err != nil {
+			fmt.Println("Fail to get Pf handle for netdev =", pfNetdevName)
+			return nil, err
+		}
+		if pf.NumVfs > 0 && len(pfHandle.List) != pf.NumVfs {
+			return nil, fmt.Errorf("externally managed pf %s has %d VFs present, want %d",
+				pfNetdevName, len(pfHandle.List), pf.NumVfs)
+		}
+		if len(pfHandle.List) == 0 {
+			return nil, fmt.Errorf("externally managed pf %s has no VFs present", pfNetdevName)
+		}
+		return pfHandle, nil
+	}
 
-	err = sriovnet.EnableSriov(pfNetdevName)
+	err := sriovnet.EnableSriov(pfNetdevName)
 	if err != nil {
 		fmt.Println("Fail to enable sriov for netdev =", pfNetdevName)
 		return nil, err
@@ -68,37 +170,75 @@ func configSriov(pfNetdevName string) (*sriovnet.PfNetdevHandle, error) {
 func NewRdmaSriovDevPlugin(config UserConfig) *RdmaSriovDevPlugin {
 
 	var devs = []*pluginapi.Device{}
+	vfResources := map[string]*vfResource{}
 
-	if len(config.PfNetdevices) == 0 {
+	if config.DeviceType != "" && config.DeviceType != DeviceTypeRdma {
+		fmt.Println("Error: unsupported deviceType", config.DeviceType, "for resource", config.ResourceName)
+	} else if len(config.PfNetdevices) == 0 {
 		fmt.Println("Error: empty or invalid pf netdevice configuration")
 	} else {
-		for _, ndev := range config.PfNetdevices {
-			fmt.Println("Configuring SRIOV on ndev=", ndev, len(ndev))
-			pfHandle, err2 := configSriov(ndev)
+		for _, pf := range config.PfNetdevices {
+			if !pf.ExternallyManaged {
+				pf.ExternallyManaged = config.ExternallyManaged
+			}
+			fmt.Println("Configuring SRIOV on ndev=", pf.Name, "externallyManaged=", pf.ExternallyManaged)
+			pfHandle, err2 := configSriov(pf)
 			if err2 != nil {
 				fmt.Println("Fail to configure sriov; error = ", err2)
 				continue
 			}
 			for _, vf := range pfHandle.List {
-				vfNetdevName := sriovnet.GetVfNetdevName(pfHandle, vf)
-				id, _ := sriovnet.GetVfDefaultMacAddr(vfNetdevName)
+				pciAddr, err3 := sriovnet.GetVfPciDevName(pfHandle, vf)
+				if err3 != nil {
+					fmt.Println("Fail to get pci address for vf; error = ", err3)
+					continue
+				}
+				if pf.VfSelector != "" {
+					matched, err3 := path.Match(pf.VfSelector, pciAddr)
+					if err3 != nil || !matched {
+						continue
+					}
+				}
+				res, err3 := newVfResource(pciAddr, sriovnet.GetVfNetdevName(pfHandle, vf))
+				if err3 != nil {
+					fmt.Println("Fail to build device spec for vf; error = ", err3)
+					continue
+				}
 				dpDevice := &pluginapi.Device{
-					ID:     id,
-					Health: pluginapi.Healthy,
+					ID:       pciAddr,
+					Health:   pluginapi.Healthy,
+					Topology: res.topology(),
 				}
 				devs = append(devs, dpDevice)
+				vfResources[pciAddr] = res
 			}
 		}
 	}
 
+	resourceName := config.ResourceName
+	if resourceName == "" {
+		resourceName = RdmaSriovResourceName
+	}
+
+	watcherMode := usesWatcherRegistration()
+	socketFile := socketFileName(resourceName)
+	socket := pluginapi.DevicePluginPath + socketFile
+	if watcherMode {
+		socket = path.Join(PluginRegistrationPath, socketFile)
+	}
+
 	return &RdmaSriovDevPlugin{
-		resourceName: RdmaSriovResourceName,
-		socket:       pluginapi.DevicePluginPath + RdmaSriovDpSocket,
+		resourceName: resourceName,
+		socket:       socket,
+		watcherMode:  watcherMode,
 
-		devs: devs,
+		devs:        devs,
+		vfResources: vfResources,
 
-		stop:   make(chan interface{}),
-		health: make(chan *pluginapi.Device),
+		stop: make(chan interface{}),
+		// Buffered so a burst of health transitions never blocks
+		// healthcheck() while ListAndWatch is between sends.
+		health: make(chan *pluginapi.Device, len(devs)+1),
 	}
 }
 
@@ -120,8 +260,25 @@ func dial(unixSocketPath string, timeout time.Duration) (*grpc.ClientConn, error
 
 // Start starts the gRPC server of the device plugin
 func (m *RdmaSriovDevPlugin) Start() error {
-	err := m.cleanup()
-	if err != nil {
+	if err := m.listen(); err != nil {
+		return err
+	}
+
+	if m.watcherMode {
+		go m.watchKubeletRestart()
+	}
+
+	go m.healthcheck()
+
+	return nil
+}
+
+// listen (re)creates the unix socket at m.socket, registers the gRPC
+// handlers on a fresh server and starts serving it. It is used both by
+// Start and, under the plugin watcher protocol, by publishSocket to
+// recover after kubelet removes our socket across a restart.
+func (m *RdmaSriovDevPlugin) listen() error {
+	if err := m.cleanup(); err != nil {
 		return err
 	}
 
@@ -132,6 +289,9 @@ func (m *RdmaSriovDevPlugin) Start() error {
 
 	m.server = grpc.NewServer([]grpc.ServerOption{}...)
 	pluginapi.RegisterDevicePluginServer(m.server, m)
+	if m.watcherMode {
+		registerapi.RegisterRegistrationServer(m.server, m)
+	}
 
 	go m.server.Serve(sock)
 
@@ -142,8 +302,6 @@ func (m *RdmaSriovDevPlugin) Start() error {
 	}
 	conn.Close()
 
-	// go m.healthcheck()
-
 	return nil
 }
 
@@ -192,15 +350,27 @@ func (m *RdmaSriovDevPlugin) ListAndWatch(e *pluginapi.Empty, s pluginapi.Device
 		case <-m.stop:
 			return nil
 		case d := <-m.health:
-			// FIXME: there is no way to recover from the Unhealthy state.
-			d.Health = pluginapi.Unhealthy
+			for _, dev := range m.devs {
+				if dev.ID == d.ID {
+					dev.Health = d.Health
+					break
+				}
+			}
 			s.Send(&pluginapi.ListAndWatchResponse{Devices: m.devs})
 		}
 	}
 }
 
-func (m *RdmaSriovDevPlugin) unhealthy(dev *pluginapi.Device) {
-	m.health <- dev
+// setHealth reports the current health of the device identified by id.
+// ListAndWatch is the only goroutine that mutates m.devs; this just hands it
+// the new state. The send races Stop() closing m.stop so that a transition
+// can never wedge healthcheck() forever when nothing is listening, e.g.
+// before kubelet's first ListAndWatch call or across a hot-reload.
+func (m *RdmaSriovDevPlugin) setHealth(id string, health string) {
+	select {
+	case m.health <- &pluginapi.Device{ID: id, Health: health}:
+	case <-m.stop:
+	}
 }
 
 // Allocate which return list of devices.
@@ -209,15 +379,37 @@ func (m *RdmaSriovDevPlugin) Allocate(ctx context.Context, r *pluginapi.Allocate
 
 	ress := make([]*pluginapi.ContainerAllocateResponse, len(r.GetContainerRequests()))
 
-	for i, _ := range r.GetContainerRequests() {
-		ds := make([]*pluginapi.DeviceSpec, 1)
-		ds[0] = &pluginapi.DeviceSpec{
-			HostPath:      RdmaDevices,
-			ContainerPath: RdmaDevices,
-			Permissions:   "rwm",
+	for i, req := range r.GetContainerRequests() {
+		// Keyed by HostPath so that a container allocated several VFs
+		// doesn't get the shared rdma_cm node duplicated once per VF.
+		dsByPath := map[string]*pluginapi.DeviceSpec{}
+		envs := map[string]string{}
+
+		for n, id := range req.DevicesIDs {
+			res, ok := m.vfResources[id]
+			if !ok {
+				return nil, fmt.Errorf("unknown device id %s", id)
+			}
+			for _, spec := range res.specs {
+				dsByPath[spec.HostPath] = spec
+			}
+			envs[fmt.Sprintf("%s%d", pciDeviceEnvPrefix(m.resourceName), n)] = res.pciAddr
+		}
+
+		if len(req.DevicesIDs) > 0 {
+			if spec := rdmaCmDeviceSpec(); spec != nil {
+				dsByPath[spec.HostPath] = spec
+			}
 		}
+
+		ds := make([]*pluginapi.DeviceSpec, 0, len(dsByPath))
+		for _, spec := range dsByPath {
+			ds = append(ds, spec)
+		}
+
 		ress[i] = &pluginapi.ContainerAllocateResponse{
 			Devices: ds,
+			Envs:    envs,
 		}
 	}
 
@@ -256,6 +448,11 @@ func (m *RdmaSriovDevPlugin) Serve() error {
 	}
 	log.Println("Starting to serve on", m.socket)
 
+	if m.watcherMode {
+		log.Println("Discovered kubelet plugin watcher, waiting for kubelet to register us")
+		return nil
+	}
+
 	err = m.Register(pluginapi.KubeletSocket, m.resourceName)
 	if err != nil {
 		log.Printf("Could not register device plugin: %s", err)